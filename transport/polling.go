@@ -1,14 +1,19 @@
 package transport
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -16,6 +21,25 @@ const (
 	PlDefaultPingTimeout    = 60 * time.Second
 	PlDefaultReceiveTimeout = 60 * time.Second
 	PlDefaultSendTimeout    = 60 * time.Second
+
+	// PlDefaultMaxPayloadBytes is the default batching budget for a single
+	// polling response: no further queued message is added once it is used
+	// up, though the last message added may take the response past it.
+	PlDefaultMaxPayloadBytes = 100000
+
+	// ProtocolV3 is the Engine.IO v2/v3 XHR-polling wire format: packets are
+	// framed as repeated "<len>:<packet>", where <len> is the UTF-8 codepoint
+	// count of the packet (including its leading type digit).
+	ProtocolV3 = 3
+	// ProtocolV4 is the Engine.IO v4 wire format: packets are separated by the
+	// ASCII record separator 0x1e.
+	ProtocolV4 = 4
+
+	// PlDefaultProtocol is used whenever a connection's EIO query parameter is
+	// missing or unrecognised.
+	PlDefaultProtocol = ProtocolV4
+
+	recordSeparator = '\x1e'
 )
 
 type PollingTransportParams struct {
@@ -24,23 +48,59 @@ type PollingTransportParams struct {
 
 type PollingConnection struct {
 	transport *PollingTransport
+	protocol  int
 	eventsIn  chan string
 	eventsOut chan string
 	errors    chan string
+
+	// readErr carries a transport-level failure (e.g. a long-poll GET that
+	// never came back) from pollLoop to GetMessage. It's distinct from
+	// errors, which is the write-ack channel WriteMessage waits on — poll
+	// failures have no WriteMessage caller to deliver to.
+	readErr chan error
+
+	// url is only set on client-side connections, i.e. ones returned from
+	// PollingTransport.Connect, which also sets sid from the handshake.
+	// Server-side connections get their sid from SetSid once the session is
+	// registered.
+	url string
+	sid string
+
+	// pingInterval and pingTimeout are only set on client-side connections,
+	// negotiated from the handshake response. Server-side connections fall
+	// back to the transport's configured values in PingParams.
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	pollMu   sync.Mutex
+	lastPoll time.Time
 }
 
 func (plc *PollingConnection) GetMessage() (string, error) {
 	select {
+	case <-plc.done:
+		return "", errors.New("use of closed connection")
 	case <-time.After(plc.transport.ReceiveTimeout):
 		return "", errors.New("Receive time out")
+	case err := <-plc.readErr:
+		return "", err
 	case msg := <-plc.eventsIn:
 		return msg, nil
 	}
 }
 
 func (plc *PollingConnection) WriteMessage(message string) error {
-	plc.eventsOut <- message
 	select {
+	case <-plc.done:
+		return errors.New("use of closed connection")
+	case plc.eventsOut <- message:
+	}
+	select {
+	case <-plc.done:
+		return errors.New("use of closed connection")
 	case <-time.After(plc.transport.SendTimeout):
 		return errors.New("Write time out")
 	case errString := <-plc.errors:
@@ -51,33 +111,98 @@ func (plc *PollingConnection) WriteMessage(message string) error {
 	return nil
 }
 
+// Close terminates the session: goroutines parked in GetMessage, WriteMessage
+// or PollingWriter are released via done, and the sid is removed from the
+// transport's session map so it stops being tracked (and reaped) once.
+// eventsIn, eventsOut and errors are never closed: every send site already
+// selects on done, so leaving them open is what actually makes a closed
+// connection safe — closing them too risks a send landing on a closed
+// channel in the gap between a sender's select firing and done taking
+// effect.
 func (plc *PollingConnection) Close() {
+	plc.closeOnce.Do(func() {
+		close(plc.done)
+		if plc.sid != "" {
+			// Only drop the session if it's still ours: a polling connection
+			// retired by Session.Upgrade must not take the upgraded session
+			// down with it.
+			if sess, ok := plc.transport.sessions.Get(plc.sid); ok && sess.Connection() == Connection(plc) {
+				plc.transport.sessions.Delete(plc.sid)
+			}
+		}
+	})
+}
+
+// sendNoopAndClose pushes a final noop ("6") packet so a long-poll GET
+// currently blocked in PollingWriter can return once more, then closes the
+// connection. Used when Session.Upgrade retires this connection in favour of
+// another transport.
+func (plc *PollingConnection) sendNoopAndClose() {
+	select {
+	case plc.eventsOut <- "6":
+	case <-plc.done:
+	case <-time.After(plc.transport.SendTimeout):
+	}
+	plc.Close()
+}
+
+// touch records that the connection was just polled, for the reaper's
+// liveness check.
+func (plc *PollingConnection) touch() {
+	plc.pollMu.Lock()
+	plc.lastPoll = time.Now()
+	plc.pollMu.Unlock()
+}
 
+func (plc *PollingConnection) lastPolledAt() time.Time {
+	plc.pollMu.Lock()
+	defer plc.pollMu.Unlock()
+	return plc.lastPoll
 }
 
 func (plc *PollingConnection) PingParams() (time.Duration, time.Duration) {
+	if plc.pingInterval != 0 || plc.pingTimeout != 0 {
+		return plc.pingInterval, plc.pingTimeout
+	}
 	return plc.transport.PingInterval, plc.transport.PingTimeout
 }
 
 // sessionMap describes sessions needed for identifying polling connections with socket.io connections
 type sessionMap struct {
 	sync.Mutex
-	sessions map[string]*PollingConnection
+	sessions map[string]*Session
+}
+
+// Set sets sid to session sess
+func (s *sessionMap) Set(sid string, sess *Session) {
+	s.Lock()
+	defer s.Unlock()
+	s.sessions[sid] = sess
 }
 
-// Set sets sid to polling connection tr
-func (s *sessionMap) Set(sid string, tr *PollingConnection) {
+// Get returns the session if it exists, and bool existence flag
+func (s *sessionMap) Get(sid string) (*Session, bool) {
 	s.Lock()
 	defer s.Unlock()
-	s.sessions[sid] = tr
+	sess, exists := s.sessions[sid]
+	return sess, exists
 }
 
-// Get returns polling connection if if exists, and bool existence flag
-func (s *sessionMap) Get(sid string) (*PollingConnection, bool) {
+// Delete removes sid from the map, if present.
+func (s *sessionMap) Delete(sid string) {
 	s.Lock()
 	defer s.Unlock()
-	tr, exists := s.sessions[sid]
-	return tr, exists
+	delete(s.sessions, sid)
+}
+
+// Each calls fn once per currently registered session. fn must not call back
+// into the sessionMap.
+func (s *sessionMap) Each(fn func(sid string, sess *Session)) {
+	s.Lock()
+	defer s.Unlock()
+	for sid, sess := range s.sessions {
+		fn(sid, sess)
+	}
 }
 
 type PollingTransport struct {
@@ -86,12 +211,188 @@ type PollingTransport struct {
 	ReceiveTimeout time.Duration
 	SendTimeout    time.Duration
 
+	// Protocol is the default Engine.IO wire protocol version (ProtocolV3 or
+	// ProtocolV4) used when a request doesn't specify one via ?EIO=.
+	Protocol int
+	// MaxPayloadBytes is the byte budget for batching queued messages into a
+	// single response (PollingWriter) or POST (client writeLoop). Batching
+	// stops once the budget is used up; messages are never split, so the last
+	// one added may take the payload past it.
+	MaxPayloadBytes int
+
 	Headers  http.Header
 	sessions sessionMap
+
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+
+	// AllowRequest, when set, vets every GET and POST that reaches Serve
+	// before it is served, e.g. to enforce auth. Returning false or a non-nil
+	// error rejects the request with 403 Forbidden. CORS preflight (OPTIONS)
+	// requests are answered without consulting it.
+	AllowRequest func(*http.Request) (bool, error)
+	// AllowedOrigins lists the Origins allowed to access this transport
+	// cross-origin. Entries may be "*", an exact origin, or a regular
+	// expression. A nil/empty slice means no CORS headers are emitted.
+	AllowedOrigins []string
 }
 
+// pollingHandshake is the JSON payload the server sends as the Engine.IO
+// open ("0") packet in response to the initial handshake GET.
+type pollingHandshake struct {
+	Sid          string   `json:"sid"`
+	Upgrades     []string `json:"upgrades"`
+	PingInterval int      `json:"pingInterval"`
+	PingTimeout  int      `json:"pingTimeout"`
+}
+
+// Connect performs the Engine.IO polling handshake against url and starts the
+// read/write loops for the resulting session. It works equally well over
+// http and https, since both are handled transparently by net/http.
 func (plt *PollingTransport) Connect(url string) (Connection, error) {
-	return nil, nil
+	protocol := plt.protocol()
+
+	body, err := plt.doRequest(http.MethodGet, fmt.Sprintf("%s?transport=polling&EIO=%d", url, protocol), nil)
+	if err != nil {
+		return nil, err
+	}
+	packets := decodePayload(protocol, string(body))
+	if len(packets) == 0 || len(packets[0]) == 0 || packets[0][0] != '0' {
+		return nil, errors.New("polling: handshake did not return an open packet")
+	}
+	var hs pollingHandshake
+	if err := json.Unmarshal([]byte(packets[0][1:]), &hs); err != nil {
+		return nil, fmt.Errorf("polling: malformed handshake: %w", err)
+	}
+
+	plc := &PollingConnection{
+		transport:    plt,
+		protocol:     protocol,
+		url:          url,
+		sid:          hs.Sid,
+		pingInterval: time.Duration(hs.PingInterval) * time.Millisecond,
+		pingTimeout:  time.Duration(hs.PingTimeout) * time.Millisecond,
+		eventsIn:     make(chan string),
+		eventsOut:    make(chan string),
+		errors:       make(chan string),
+		readErr:      make(chan error),
+		done:         make(chan struct{}),
+		lastPoll:     time.Now(),
+	}
+
+	go plc.pollLoop()
+	go plc.writeLoop()
+
+	return plc, nil
+}
+
+// protocol returns the transport's configured protocol version, falling back
+// to PlDefaultProtocol when unset.
+func (plt *PollingTransport) protocol() int {
+	if plt.Protocol != 0 {
+		return plt.Protocol
+	}
+	return PlDefaultProtocol
+}
+
+// doRequest issues an HTTP request carrying the transport's configured
+// Headers (auth cookies, a custom Origin, User-Agent, ...) and returns the
+// response body.
+func (plt *PollingTransport) doRequest(method, url string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for header, values := range plt.Headers {
+		for _, value := range values {
+			req.Header.Add(header, value)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// pollURL builds the client-side request URL for both the long-poll GET and
+// the message POST, which share the same sid-qualified endpoint.
+func (plc *PollingConnection) pollURL() string {
+	return fmt.Sprintf("%s?transport=polling&EIO=%d&sid=%s", plc.url, plc.protocol, plc.sid)
+}
+
+// pollLoop continuously issues long-poll GETs on a client-side connection and
+// feeds the decoded packets into eventsIn until the connection is closed. The
+// first failed GET is handed to GetMessage via readErr and ends the loop.
+func (plc *PollingConnection) pollLoop() {
+	for {
+		select {
+		case <-plc.done:
+			return
+		default:
+		}
+
+		body, err := plc.transport.doRequest(http.MethodGet, plc.pollURL(), nil)
+		if err != nil {
+			select {
+			case plc.readErr <- err:
+			case <-plc.done:
+			}
+			return
+		}
+		plc.touch()
+		for _, packet := range decodePayload(plc.protocol, string(body)) {
+			select {
+			case plc.eventsIn <- packet:
+			case <-plc.done:
+				return
+			}
+		}
+	}
+}
+
+// writeLoop batches queued eventsOut messages into POST bodies using the same
+// framing PollingWriter uses server-side, and reports the outcome back to
+// WriteMessage over errors.
+func (plc *PollingConnection) writeLoop() {
+	for {
+		var msg string
+		select {
+		case msg = <-plc.eventsOut:
+		case <-plc.done:
+			return
+		}
+
+		packets := []string{msg}
+		budget := plc.transport.maxPayloadBytes() - len(msg)
+	batch:
+		for budget > 0 {
+			select {
+			case next := <-plc.eventsOut:
+				packets = append(packets, next)
+				budget -= len(next)
+			default:
+				break batch
+			}
+		}
+
+		_, err := plc.transport.doRequest(http.MethodPost, plc.pollURL(), strings.NewReader(encodePayload(plc.protocol, packets)))
+		result := "0"
+		if err != nil {
+			result = err.Error()
+		}
+		// One ack per batched message: each came from its own blocked
+		// WriteMessage call, and every one of them is waiting on errors.
+		for range packets {
+			select {
+			case plc.errors <- result:
+			case <-plc.done:
+				return
+			}
+		}
+	}
 }
 
 func (plt *PollingTransport) HandleConnection(w http.ResponseWriter, r *http.Request) (Connection, error) {
@@ -99,21 +400,69 @@ func (plt *PollingTransport) HandleConnection(w http.ResponseWriter, r *http.Req
 	eventOutChan := make(chan string)
 	plc := &PollingConnection{
 		transport: plt,
+		protocol:  protocolFromQuery(r, plt.protocol()),
 		eventsIn:  eventChan,
 		eventsOut: eventOutChan,
 		errors:    make(chan string),
+		done:      make(chan struct{}),
+		lastPoll:  time.Now(),
 	}
 
 	return plc, nil
 }
 
 func (plt *PollingTransport) SetSid(sid string, conn Connection) {
-	plt.sessions.Set(sid, conn.(*PollingConnection))
+	plc := conn.(*PollingConnection)
+	plc.sid = sid
+	plt.sessions.Set(sid, newSession(sid, plc))
+}
+
+// Session returns the shared Session registered for sid, if any. Other
+// transports (e.g. websocket) use this to find an in-progress polling session
+// and swap in their own Connection via Session.Upgrade, so a client can move
+// from long-polling to websocket mid-session without losing its sid.
+func (plt *PollingTransport) Session(sid string) (*Session, bool) {
+	return plt.sessions.Get(sid)
+}
+
+// protocolFromQuery negotiates the wire protocol from the request's EIO query
+// parameter, falling back to def when it is absent or unrecognised.
+func protocolFromQuery(r *http.Request, def int) int {
+	switch r.URL.Query().Get("EIO") {
+	case "3":
+		return ProtocolV3
+	case "4":
+		return ProtocolV4
+	default:
+		return def
+	}
+}
+
+func (plt *PollingTransport) maxPayloadBytes() int {
+	if plt.MaxPayloadBytes > 0 {
+		return plt.MaxPayloadBytes
+	}
+	return PlDefaultMaxPayloadBytes
 }
 
 func (plt *PollingTransport) Serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		plt.serveOptions(w, r)
+		return
+	}
+	if plt.AllowRequest != nil {
+		if ok, err := plt.AllowRequest(r); err != nil || !ok {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
 	sessionId := r.URL.Query().Get("sid")
-	conn, exists := plt.sessions.Get(sessionId)
+	sess, exists := plt.sessions.Get(sessionId)
+	var conn *PollingConnection
+	if exists {
+		conn, exists = sess.Connection().(*PollingConnection)
+	}
 	switch r.Method {
 	case http.MethodGet:
 		if !exists {
@@ -121,63 +470,300 @@ func (plt *PollingTransport) Serve(w http.ResponseWriter, r *http.Request) {
 		}
 		conn.PollingWriter(w, r)
 	case http.MethodPost:
-		bodyBytes, err := ioutil.ReadAll(r.Body)
+		if !exists {
+			return
+		}
+		bodyString, err := readPostBody(r)
 		if err != nil {
 			fmt.Println("error in PollingTransport.Serve():", err)
 			return
 		}
-		bodyString := string(bodyBytes)
-		index := strings.Index(bodyString, ":")
-		body := bodyString[index+1:]
-		setHeaders(w)
+		plt.setHeaders(w, r)
 		w.Write([]byte("ok"))
-		conn.eventsIn <- body
+		for _, packet := range decodePayload(conn.protocol, bodyString) {
+			select {
+			case conn.eventsIn <- packet:
+			case <-conn.done:
+				return
+			}
+		}
+	}
+}
+
+// readPostBody returns the packet payload from a POST, whether it arrived as
+// a raw XHR body or as the "d" field of a JSONP form POST.
+func readPostBody(r *http.Request) (string, error) {
+	if strings.Contains(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return r.FormValue("d"), nil
 	}
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(bodyBytes), nil
+}
+
+// serveOptions answers a CORS preflight request.
+func (plt *PollingTransport) serveOptions(w http.ResponseWriter, r *http.Request) {
+	plt.setCORSHeaders(w, r)
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+		w.Header().Set("Access-Control-Allow-Headers", reqHeaders)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setCORSHeaders emits Access-Control-Allow-* headers when the request's
+// Origin is permitted by AllowedOrigins.
+func (plt *PollingTransport) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !plt.originAllowed(origin) {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+}
+
+func (plt *PollingTransport) originAllowed(origin string) bool {
+	for _, allowed := range plt.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if matched, _ := regexp.MatchString(allowed, origin); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonpIndex returns the j= script index of a JSONP request and whether the
+// request carried a valid one. Like the reference Engine.IO server, j must
+// be numeric: a non-numeric value is treated the same as no index at all
+// instead of being interpolated into the response verbatim, which would let
+// a request like ?j=];alert(1)// inject arbitrary script.
+func jsonpIndex(r *http.Request) (int, bool) {
+	raw := r.URL.Query().Get("j")
+	if raw == "" {
+		return 0, false
+	}
+	index, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, false
+	}
+	return index, true
+}
+
+// jsonpWrap frames payload as a JSONP response body, escaping characters that
+// would otherwise break out of the enclosing string literal or, for the
+// U+2028/U+2029 line separators, be silently stripped by some JS engines.
+func jsonpWrap(index int, payload string) string {
+	escaped := strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		"\r", `\r`,
+		" ", `\u2028`,
+		" ", `\u2029`,
+	).Replace(payload)
+	return fmt.Sprintf("___eio[%d](\"%s\");", index, escaped)
 }
 
 /**
 Returns polling transport with default params
 */
 func GetDefaultPollingTransport() *PollingTransport {
-	return &PollingTransport{
-		PingInterval:   PlDefaultPingInterval,
-		PingTimeout:    PlDefaultPingTimeout,
-		ReceiveTimeout: PlDefaultReceiveTimeout,
-		SendTimeout:    PlDefaultSendTimeout,
+	plt := &PollingTransport{
+		PingInterval:    PlDefaultPingInterval,
+		PingTimeout:     PlDefaultPingTimeout,
+		ReceiveTimeout:  PlDefaultReceiveTimeout,
+		SendTimeout:     PlDefaultSendTimeout,
+		Protocol:        PlDefaultProtocol,
+		MaxPayloadBytes: PlDefaultMaxPayloadBytes,
 		sessions: sessionMap{
 			Mutex:    sync.Mutex{},
-			sessions: map[string]*PollingConnection{},
+			sessions: map[string]*Session{},
 		},
-		Headers: nil,
+		Headers:  nil,
+		shutdown: make(chan struct{}),
+	}
+	go plt.reap()
+	return plt
+}
+
+// reap closes any session that hasn't been polled within PingInterval plus
+// PingTimeout, the Engine.IO liveness rule, so browsers that vanished without
+// a clean disconnect don't leak their PollingConnection forever.
+func (plt *PollingTransport) reap() {
+	ticker := time.NewTicker(plt.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-plt.shutdown:
+			return
+		case <-ticker.C:
+			deadline := plt.PingInterval + plt.PingTimeout
+			var dead []*PollingConnection
+			plt.sessions.Each(func(sid string, sess *Session) {
+				conn, ok := sess.Connection().(*PollingConnection)
+				if !ok {
+					// Upgraded to another transport, which now owns liveness.
+					return
+				}
+				if time.Since(conn.lastPolledAt()) > deadline {
+					dead = append(dead, conn)
+				}
+			})
+			// Close outside Each's lock: Close reaches back into the
+			// sessionMap via Get/Delete, and Each must not call back in.
+			for _, conn := range dead {
+				conn.Close()
+			}
+		}
 	}
 }
 
+// Shutdown stops the background session reaper. It does not close sessions
+// that are still active.
+func (plt *PollingTransport) Shutdown() {
+	plt.shutdownOnce.Do(func() {
+		close(plt.shutdown)
+	})
+}
+
+// PollingWriter answers a long-poll GET, batching every message currently
+// queued in eventsOut (until the transport's MaxPayloadBytes budget is used
+// up) into a single framed response instead of sending one packet per
+// round-trip.
 func (plc *PollingConnection) PollingWriter(w http.ResponseWriter, r *http.Request) {
-	setHeaders(w)
+	plc.touch()
+	plc.transport.setHeaders(w, r)
 	select {
+	case <-plc.done:
+		return
 	case <-time.After(plc.transport.PingTimeout):
-		_, err := w.Write([]byte("1:3"))
-		if err != nil {
-			plc.errors <- err.Error()
-			return
+		// Nothing queued in eventsOut, so no WriteMessage caller is waiting
+		// on an ack for this packet.
+		plc.writePayload(w, r, []string{"3"}, 0)
+	case msg := <-plc.eventsOut:
+		packets := []string{msg}
+		budget := plc.transport.maxPayloadBytes() - len(msg)
+	drain:
+		for budget > 0 {
+			select {
+			case next := <-plc.eventsOut:
+				packets = append(packets, next)
+				budget -= len(next)
+			default:
+				break drain
+			}
 		}
-		plc.errors <- "0"
-	case events := <-plc.eventsOut:
-		events = strconv.Itoa(len(events)) + ":" + events
-		_, err := w.Write([]byte(events))
-		if err != nil {
-			plc.errors <- err.Error()
+		plc.writePayload(w, r, packets, len(packets))
+	}
+}
+
+// writePayload writes packets as a single framed response, then sends acks
+// on errors — as many as acks, one per batched message — so every blocked
+// WriteMessage caller gets its own result.
+func (plc *PollingConnection) writePayload(w http.ResponseWriter, r *http.Request, packets []string, acks int) {
+	payload := encodePayload(plc.protocol, packets)
+	if index, ok := jsonpIndex(r); ok {
+		payload = jsonpWrap(index, payload)
+	}
+	_, err := w.Write([]byte(payload))
+	result := "0"
+	if err != nil {
+		result = err.Error()
+	}
+	for i := 0; i < acks; i++ {
+		select {
+		case plc.errors <- result:
+		case <-plc.done:
 			return
 		}
-		plc.errors <- "0"
 	}
 }
 
-func setHeaders(w http.ResponseWriter) {
-	// We are going to return JSON no matter what:
+// encodePayload serializes packets into a single wire payload using the given
+// Engine.IO protocol version. Packets that aren't valid UTF-8 are treated as
+// binary and sent base64-encoded with a leading "b" marker.
+func encodePayload(protocol int, packets []string) string {
+	var b strings.Builder
+	for i, p := range packets {
+		frame := p
+		if !utf8.ValidString(p) {
+			frame = "b" + base64.StdEncoding.EncodeToString([]byte(p))
+		}
+		if protocol == ProtocolV3 {
+			b.WriteString(strconv.Itoa(utf8.RuneCountInString(frame)))
+			b.WriteByte(':')
+			b.WriteString(frame)
+			continue
+		}
+		if i > 0 {
+			b.WriteRune(recordSeparator)
+		}
+		b.WriteString(frame)
+	}
+	return b.String()
+}
+
+// decodePayload splits a wire payload produced by encodePayload back into its
+// individual packets, reversing the base64 "b" framing for binary packets.
+func decodePayload(protocol int, payload string) []string {
+	if payload == "" {
+		return nil
+	}
+	var frames []string
+	if protocol == ProtocolV3 {
+		runes := []rune(payload)
+		for len(runes) > 0 {
+			idx := strings.IndexRune(string(runes), ':')
+			if idx < 0 {
+				break
+			}
+			length, err := strconv.Atoi(string(runes[:idx]))
+			if err != nil {
+				break
+			}
+			start, end := idx+1, idx+1+length
+			if end > len(runes) {
+				end = len(runes)
+			}
+			frames = append(frames, string(runes[start:end]))
+			runes = runes[end:]
+		}
+	} else {
+		frames = strings.Split(payload, string(recordSeparator))
+	}
+
+	packets := make([]string, 0, len(frames))
+	for _, frame := range frames {
+		if strings.HasPrefix(frame, "b") {
+			if raw, err := base64.StdEncoding.DecodeString(frame[1:]); err == nil {
+				packets = append(packets, string(raw))
+				continue
+			}
+		}
+		packets = append(packets, frame)
+	}
+	return packets
+}
+
+// setHeaders applies the no-cache headers every response needs, CORS headers
+// when the transport allows the requester's Origin, and a JSON or JSONP
+// Content-Type depending on whether the request carries a j= index.
+func (plt *PollingTransport) setHeaders(w http.ResponseWriter, r *http.Request) {
+	setNoCacheHeaders(w)
+	plt.setCORSHeaders(w, r)
+	if _, ok := jsonpIndex(r); ok {
+		w.Header().Set("Content-Type", "text/javascript; charset=UTF-8")
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	// Don't cache response:
+}
+
+func setNoCacheHeaders(w http.ResponseWriter) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate") // HTTP 1.1.
 	w.Header().Set("Pragma", "no-cache")                                   // HTTP 1.0.
 	w.Header().Set("Expires", "0")                                         // Proxies.
-}
\ No newline at end of file
+}
@@ -0,0 +1,58 @@
+package transport
+
+import "sync"
+
+// Session is the state of a single Engine.IO connection that survives a
+// transport upgrade: the sid and the currently active Connection, plus any
+// packets queued while a new Connection is being swapped in. PollingTransport
+// creates a Session for every sid it hands out; the websocket transport looks
+// sessions up by sid to take over from polling once a client upgrades,
+// without losing the sid or any packets still in flight.
+type Session struct {
+	sid string
+
+	mu      sync.Mutex
+	conn    Connection
+	pending []string
+}
+
+func newSession(sid string, conn Connection) *Session {
+	return &Session{sid: sid, conn: conn}
+}
+
+// Connection returns the session's currently active Connection.
+func (s *Session) Connection() Connection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// Buffer queues a packet for delivery the next time the session's Connection
+// is swapped in, for callers that can't write to the current Connection
+// directly (e.g. while an upgrade is in flight).
+func (s *Session) Buffer(packet string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, packet)
+}
+
+// Upgrade atomically swaps in next as the session's active Connection and
+// flushes any packets buffered by Buffer across it. The previous Connection
+// is retired: if it was a polling connection, a final noop packet is pushed
+// to unblock its pending long-poll GET before it's closed.
+func (s *Session) Upgrade(next Connection) {
+	s.mu.Lock()
+	previous := s.conn
+	pending := s.pending
+	s.pending = nil
+	s.conn = next
+	s.mu.Unlock()
+
+	for _, packet := range pending {
+		next.WriteMessage(packet)
+	}
+
+	if plc, ok := previous.(*PollingConnection); ok && plc != nil {
+		go plc.sendNoopAndClose()
+	}
+}